@@ -0,0 +1,194 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// AuthToken represents a long-term "remember me" token using a selector/verifier split so that
+// the cookie value can never be reconstructed from what is stored in the database. Only the
+// selector is used to find the row; the validator is checked against its stored hash.
+type AuthToken struct {
+	ID              string             `xorm:"pk VARCHAR(32)"`
+	HashedValidator string             `xorm:"NOT NULL VARCHAR(64)"`
+	UserID          int64              `xorm:"INDEX NOT NULL"`
+	ExpiresUnix     timeutil.TimeStamp `xorm:"NOT NULL"`
+}
+
+// TableName overrides the table name used for AuthToken
+func (AuthToken) TableName() string {
+	return "auth_token"
+}
+
+const (
+	authTokenSelectorLength  = 16
+	authTokenValidatorLength = 32
+)
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("rand.Read: %v", err)
+	}
+	return b, nil
+}
+
+func hashValidator(validator []byte) string {
+	sum := sha256.Sum256(validator)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAuthToken creates and stores a new selector/verifier pair for the given user and returns
+// the "selector:validator" value that should be placed in the remember-me cookie.
+func NewAuthToken(userID int64, expires timeutil.TimeStamp) (string, error) {
+	selector, err := randomBytes(authTokenSelectorLength)
+	if err != nil {
+		return "", err
+	}
+	validator, err := randomBytes(authTokenValidatorLength)
+	if err != nil {
+		return "", err
+	}
+
+	token := &AuthToken{
+		ID:              hex.EncodeToString(selector),
+		HashedValidator: hashValidator(validator),
+		UserID:          userID,
+		ExpiresUnix:     expires,
+	}
+	if _, err := x.Insert(token); err != nil {
+		return "", err
+	}
+
+	return encodeAuthCookie(token.ID, validator), nil
+}
+
+func encodeAuthCookie(selector string, validator []byte) string {
+	return selector + ":" + base64.RawURLEncoding.EncodeToString(validator)
+}
+
+func decodeAuthCookie(value string) (selector string, validator []byte, err error) {
+	for i := 0; i < len(value); i++ {
+		if value[i] == ':' {
+			selector = value[:i]
+			validator, err = base64.RawURLEncoding.DecodeString(value[i+1:])
+			return
+		}
+	}
+	return "", nil, fmt.Errorf("malformed auth token cookie")
+}
+
+// VerifyAuthToken looks up the selector encoded in cookieValue, constant-time compares the
+// hashed validator, and, on success, rotates the token (issuing a new selector/validator pair
+// and deleting the old one) before returning the owning user and the new cookie value.
+//
+// If the selector is found but the validator does not match, every token belonging to that
+// user is deleted and an error is returned: a hash mismatch on a live selector most likely
+// means a stolen cookie value is being replayed, so the whole session family is invalidated.
+func VerifyAuthToken(cookieValue string) (user *User, newCookieValue string, err error) {
+	selector, validator, err := decodeAuthCookie(cookieValue)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := &AuthToken{ID: selector}
+	has, err := x.Get(token)
+	if err != nil {
+		return nil, "", err
+	}
+	if !has {
+		return nil, "", ErrAuthTokenNotExist{Selector: selector}
+	}
+
+	if token.ExpiresUnix.AsTime().Before(timeutil.TimeStampNow().AsTime()) {
+		_, _ = x.Delete(token)
+		return nil, "", ErrAuthTokenExpired{Selector: selector}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashValidator(validator)), []byte(token.HashedValidator)) != 1 {
+		if delErr := DeleteAuthTokensByUser(token.UserID); delErr != nil {
+			return nil, "", delErr
+		}
+		return nil, "", ErrAuthTokenCompromised{UserID: token.UserID}
+	}
+
+	user, err = GetUserByID(token.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newCookieValue, err = NewAuthToken(token.UserID, token.ExpiresUnix)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := x.Delete(&AuthToken{ID: selector}); err != nil {
+		return nil, "", err
+	}
+
+	return user, newCookieValue, nil
+}
+
+// DeleteAuthTokensByUser removes every auth token belonging to the given user, forcing any
+// device relying on a remember-me cookie to sign in again.
+func DeleteAuthTokensByUser(userID int64) error {
+	_, err := x.Delete(&AuthToken{UserID: userID})
+	return err
+}
+
+// DeleteExpiredAuthTokens is a reaper, intended to be run periodically, that removes auth
+// tokens whose expiry has already passed.
+func DeleteExpiredAuthTokens() error {
+	_, err := x.Where("expires_unix <= ?", timeutil.TimeStampNow()).Delete(&AuthToken{})
+	return err
+}
+
+// StartAuthTokenReaper runs DeleteExpiredAuthTokens on every tick of interval until the
+// program exits. It is meant to be started once, in its own goroutine, during application
+// start-up, so expired rows don't accumulate in auth_token forever.
+func StartAuthTokenReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := DeleteExpiredAuthTokens(); err != nil {
+			log.Error("DeleteExpiredAuthTokens: %v", err)
+		}
+	}
+}
+
+// ErrAuthTokenNotExist represents a "auth token not exist" error
+type ErrAuthTokenNotExist struct {
+	Selector string
+}
+
+func (err ErrAuthTokenNotExist) Error() string {
+	return fmt.Sprintf("auth token does not exist [selector: %s]", err.Selector)
+}
+
+// ErrAuthTokenExpired represents a "auth token expired" error
+type ErrAuthTokenExpired struct {
+	Selector string
+}
+
+func (err ErrAuthTokenExpired) Error() string {
+	return fmt.Sprintf("auth token has expired [selector: %s]", err.Selector)
+}
+
+// ErrAuthTokenCompromised represents the case where a validator did not match a known
+// selector, indicating the cookie value may have been stolen from the database or leaked.
+type ErrAuthTokenCompromised struct {
+	UserID int64
+}
+
+func (err ErrAuthTokenCompromised) Error() string {
+	return fmt.Sprintf("auth token validator mismatch, all tokens revoked [user_id: %d]", err.UserID)
+}
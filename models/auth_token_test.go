@@ -0,0 +1,66 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"crypto/subtle"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomBytesLength(t *testing.T) {
+	b, err := randomBytes(authTokenValidatorLength)
+	assert.NoError(t, err)
+	assert.Len(t, b, authTokenValidatorLength)
+}
+
+func TestRandomBytesAreNotConstant(t *testing.T) {
+	a, err := randomBytes(authTokenValidatorLength)
+	assert.NoError(t, err)
+	b, err := randomBytes(authTokenValidatorLength)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, b, "two draws of random validator bytes should not collide")
+}
+
+func TestHashValidatorIsDeterministic(t *testing.T) {
+	validator := []byte("a-fixed-validator-for-testing-only")
+	assert.Equal(t, hashValidator(validator), hashValidator(validator))
+}
+
+func TestHashValidatorDiffersOnTamperedInput(t *testing.T) {
+	original := hashValidator([]byte("the real validator"))
+	tampered := hashValidator([]byte("a swapped validator"))
+	assert.NotEqual(t, original, tampered)
+}
+
+func TestEncodeDecodeAuthCookieRoundTrip(t *testing.T) {
+	validator := []byte("0123456789abcdef0123456789abcdef")
+	cookie := encodeAuthCookie("deadbeef", validator)
+
+	selector, decodedValidator, err := decodeAuthCookie(cookie)
+	assert.NoError(t, err)
+	assert.Equal(t, "deadbeef", selector)
+	assert.Equal(t, validator, decodedValidator)
+}
+
+func TestDecodeAuthCookieRejectsMalformedValue(t *testing.T) {
+	_, _, err := decodeAuthCookie("not-a-selector-validator-pair")
+	assert.Error(t, err)
+}
+
+// TestValidatorCompareDetectsMismatch exercises the same constant-time comparison
+// VerifyAuthToken performs between the hash of the presented validator and the one stored on
+// the AuthToken row, which is what decides whether a cookie is accepted or treated as a
+// possible theft-and-replay (see ErrAuthTokenCompromised).
+func TestValidatorCompareDetectsMismatch(t *testing.T) {
+	stored := hashValidator([]byte("the real validator"))
+
+	matches := subtle.ConstantTimeCompare([]byte(hashValidator([]byte("the real validator"))), []byte(stored)) == 1
+	assert.True(t, matches)
+
+	matches = subtle.ConstantTimeCompare([]byte(hashValidator([]byte("a stolen, guessed validator"))), []byte(stored)) == 1
+	assert.False(t, matches)
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import (
+	"fmt"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"xorm.io/xorm"
+)
+
+// Migration describes a single, ordered step used to bring an existing database up to the
+// schema the current code expects.
+type Migration interface {
+	Description() string
+	Migrate(*xorm.Engine) error
+}
+
+type migration struct {
+	description string
+	migrate     func(*xorm.Engine) error
+}
+
+// NewMigration creates a Migration from a description and the function that performs it.
+func NewMigration(desc string, fn func(*xorm.Engine) error) Migration {
+	return &migration{desc, fn}
+}
+
+func (m *migration) Description() string {
+	return m.description
+}
+
+func (m *migration) Migrate(x *xorm.Engine) error {
+	return m.migrate(x)
+}
+
+// migrations is the ordered list of migrations applied on top of whatever schema version the
+// database is currently at. New migrations are appended to the end of this list, never
+// inserted earlier, since Migrate tracks progress by position.
+var migrations = []Migration{
+	NewMigration("add auth_token table and drop legacy remember_token columns", addAuthTokenTable),
+}
+
+// Migrate applies every migration in migrations that hasn't already run against x, recording
+// progress in the `version` table as it goes.
+func Migrate(x *xorm.Engine) error {
+	if err := x.Sync2(new(Version)); err != nil {
+		return fmt.Errorf("sync version table: %v", err)
+	}
+
+	currentVersion := &Version{ID: 1}
+	has, err := x.Get(currentVersion)
+	if err != nil {
+		return fmt.Errorf("get current db version: %v", err)
+	}
+	if !has {
+		currentVersion.ID = 1
+		currentVersion.Version = int64(len(migrations))
+		if _, err := x.InsertOne(currentVersion); err != nil {
+			return fmt.Errorf("insert current db version: %v", err)
+		}
+	}
+
+	v := currentVersion.Version
+	for i, m := range migrations[v:] {
+		if err := m.Migrate(x); err != nil {
+			return fmt.Errorf("migration[%d] %s: %v", v+int64(i), m.Description(), err)
+		}
+		currentVersion.Version = v + int64(i) + 1
+		if _, err := x.ID(1).Update(currentVersion); err != nil {
+			return fmt.Errorf("update db version to %d: %v", currentVersion.Version, err)
+		}
+	}
+	return nil
+}
+
+// Version tracks how many migrations have been applied to the database.
+type Version struct {
+	ID      int64 `xorm:"pk autoincr"`
+	Version int64
+}
+
+// dropTableColumns drops columnNames from tableName, if the table exists at all - a table
+// that was never created (a fresh install has no legacy schema to clean up) is left alone.
+// Some dialects (notably older SQLite, which lacks DROP COLUMN) can't perform this; such
+// failures are logged and skipped rather than failing the whole migration, since a stale
+// column left behind is harmless, unlike a server that refuses to start.
+func dropTableColumns(x *xorm.Engine, tableName string, columnNames ...string) error {
+	exists, err := x.IsTableExist(tableName)
+	if err != nil {
+		return fmt.Errorf("check %s exists: %v", tableName, err)
+	}
+	if !exists {
+		return nil
+	}
+
+	for _, col := range columnNames {
+		if _, err := x.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableName, col)); err != nil {
+			log.Warn("dropTableColumns: could not drop %s.%s (%v), leaving it in place", tableName, col, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import (
+	"xorm.io/xorm"
+)
+
+func addAuthTokenTable(x *xorm.Engine) error {
+	type AuthToken struct {
+		ID              string `xorm:"pk VARCHAR(32)"`
+		HashedValidator string `xorm:"NOT NULL VARCHAR(64)"`
+		UserID          int64  `xorm:"INDEX NOT NULL"`
+		ExpiresUnix     int64  `xorm:"NOT NULL"`
+	}
+
+	if err := x.Sync2(new(AuthToken)); err != nil {
+		return err
+	}
+
+	// The old remember-me cookie was reconstructible directly from these columns, which meant
+	// a leaked database dump let an attacker forge a valid cookie. They are superseded by the
+	// selector/verifier pair stored in auth_token above.
+	return dropTableColumns(x, "remember_token", "uid", "token")
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// WebAuthnCredential represents a single registered WebAuthn authenticator (a passkey) bound
+// to a user. CredentialID holds the authenticator's raw credential-ID bytes base64-encoded
+// (encoding/base64.RawStdEncoding): those bytes are attacker-controlled and not guaranteed to
+// be valid UTF-8, which a raw byte-to-string cast would silently corrupt on any database that
+// rejects or mangles invalid UTF-8 in a VARCHAR column (Postgres, MySQL in strict mode).
+type WebAuthnCredential struct {
+	ID              int64  `xorm:"pk autoincr"`
+	Name            string `xorm:"NOT NULL"`
+	UserID          int64  `xorm:"INDEX NOT NULL"`
+	CredentialID    string `xorm:"INDEX VARCHAR(410) NOT NULL"`
+	PublicKey       []byte `xorm:"NOT NULL"`
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32             `xorm:"NOT NULL DEFAULT 0"`
+	CloneWarning    bool
+	CreatedUnix     timeutil.TimeStamp `xorm:"created"`
+	UpdatedUnix     timeutil.TimeStamp `xorm:"updated"`
+}
+
+// TableName overrides the table name used for WebAuthnCredential
+func (WebAuthnCredential) TableName() string {
+	return "webauthn_credential"
+}
+
+// GetWebAuthnCredentialsByUID returns all passkeys registered to the given user.
+func GetWebAuthnCredentialsByUID(uid int64) ([]*WebAuthnCredential, error) {
+	creds := make([]*WebAuthnCredential, 0, 4)
+	return creds, x.Where("user_id = ?", uid).Find(&creds)
+}
+
+// HasWebAuthnRegistration reports whether the user has registered at least one passkey.
+func HasWebAuthnRegistration(uid int64) (bool, error) {
+	return x.Where("user_id = ?", uid).Exist(&WebAuthnCredential{})
+}
+
+// GetWebAuthnCredentialByCredID finds a credential by its raw credential ID, used by the
+// usernameless/discoverable-credential login flow where the user is not yet known.
+func GetWebAuthnCredentialByCredID(rawCredentialID []byte) (*WebAuthnCredential, error) {
+	encoded := base64.RawStdEncoding.EncodeToString(rawCredentialID)
+	cred := &WebAuthnCredential{CredentialID: encoded}
+	has, err := x.Get(cred)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, ErrWebAuthnCredentialNotExist{CredentialID: encoded}
+	}
+	return cred, nil
+}
+
+// UpdateSignCount persists the authenticator's new signature counter, used to detect cloned
+// authenticators (a counter that goes backwards indicates the key material was duplicated).
+func (cred *WebAuthnCredential) UpdateSignCount() error {
+	_, err := x.ID(cred.ID).Cols("sign_count", "clone_warning").Update(cred)
+	return err
+}
+
+// CreateCredential persists a newly registered passkey for a user. rawCredentialID is the
+// authenticator's raw credential-ID bytes, which are base64-encoded before being stored.
+func CreateCredential(userID int64, name string, rawCredentialID []byte, publicKey, aaguid []byte, attestationType string, signCount uint32) (*WebAuthnCredential, error) {
+	cred := &WebAuthnCredential{
+		UserID:          userID,
+		Name:            name,
+		CredentialID:    base64.RawStdEncoding.EncodeToString(rawCredentialID),
+		PublicKey:       publicKey,
+		AAGUID:          aaguid,
+		AttestationType: attestationType,
+		SignCount:       signCount,
+	}
+	_, err := x.Insert(cred)
+	return cred, err
+}
+
+// ErrWebAuthnCredentialNotExist represents a "WebAuthnCredential not exist" error
+type ErrWebAuthnCredentialNotExist struct {
+	CredentialID string
+}
+
+func (err ErrWebAuthnCredentialNotExist) Error() string {
+	return fmt.Sprintf("WebAuthn credential does not exist [credential_id: %s]", err.CredentialID)
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sso
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/auth/oauth2"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// containerTokenTTL is how long an issued registry token remains valid, mirroring the short
+// lifetime the OCI distribution spec expects of bearer tokens.
+const containerTokenTTL = 5 * time.Minute
+
+var (
+	containerBasePathRe  = regexp.MustCompile(`^/v2/?$`)
+	containerScopePathRe = regexp.MustCompile(`^/v2/(?P<name>[a-zA-Z0-9_.\-/]+)/(?:manifests|blobs|tags)/`)
+)
+
+// isContainerPath reports whether req targets the OCI/Docker container registry API, i.e.
+// `/v2/` itself or `/v2/<owner>/<image>/...`.
+func isContainerPath(req *http.Request) bool {
+	return containerBasePathRe.MatchString(req.URL.Path) || containerScopePathRe.MatchString(req.URL.Path)
+}
+
+// containerScope extracts the "<owner>/<image>" repository name a container registry request
+// is addressed to, if any.
+func containerScope(req *http.Request) string {
+	m := containerScopePathRe.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// ContainerAuthenticateHeader builds the WWW-Authenticate challenge returned to an
+// unauthenticated `/v2/` request, pointing the client at the token endpoint and the scope it
+// should request a token for.
+func ContainerAuthenticateHeader(req *http.Request) string {
+	scope := containerScope(req)
+	if scope == "" {
+		return fmt.Sprintf(`Bearer realm="%s/v2/token",service="%s"`, strings.TrimSuffix(setting.AppURL, "/"), setting.Domain)
+	}
+	return fmt.Sprintf(`Bearer realm="%s/v2/token",service="%s",scope="repository:%s:pull,push"`,
+		strings.TrimSuffix(setting.AppURL, "/"), setting.Domain, scope)
+}
+
+// containerAccess is a single entry of the JWT "access" claim, as defined by the OCI
+// distribution token specification.
+type containerAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type containerTokenClaims struct {
+	jwt.StandardClaims
+	Access []containerAccess `json:"access"`
+}
+
+// IssueContainerToken signs a short-lived JWT granting user the requested actions on scope
+// (an "<owner>/<image>" repository name), for use against the `/v2/` API.
+func IssueContainerToken(user *models.User, scope string, actions []string) (string, error) {
+	now := time.Now()
+	claims := containerTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   fmt.Sprintf("%d", user.ID),
+			Issuer:    strings.TrimSuffix(setting.AppURL, "/"),
+			Audience:  setting.Domain,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(containerTokenTTL).Unix(),
+		},
+	}
+	if scope != "" {
+		claims.Access = []containerAccess{{Type: "repository", Name: scope, Actions: actions}}
+	}
+
+	token := jwt.NewWithClaims(oauth2.DefaultSigningKey.SigningMethod(), claims)
+	return token.SignedString(oauth2.DefaultSigningKey.SignKey())
+}
+
+// Ensure the struct implements the interface.
+var (
+	_ SingleSignOn = &OAuth2Token{}
+)
+
+// OAuth2Token implements the SingleSignOn interface and authenticates container registry
+// requests bearing a JWT previously issued by IssueContainerToken.
+type OAuth2Token struct {
+}
+
+// Init does nothing
+func (o *OAuth2Token) Init() error {
+	return nil
+}
+
+// Free does nothing
+func (o *OAuth2Token) Free() error {
+	return nil
+}
+
+// IsEnabled returns true as this plugin is enabled by default and it is not possible to
+// disable it from settings.
+func (o *OAuth2Token) IsEnabled() bool {
+	return true
+}
+
+// VerifyAuthData validates a "Bearer" JWT issued for the container registry and returns its
+// subject user. Only container registry requests are accepted; other bearer tokens (OAuth2
+// access tokens) are handled by the existing OAuth2 plugin.
+func (o *OAuth2Token) VerifyAuthData(req *http.Request, w http.ResponseWriter, store SessionStore) *models.User {
+	if !isContainerPath(req) {
+		return nil
+	}
+
+	auHead := req.Header.Get("Authorization")
+	if len(auHead) == 0 {
+		return nil
+	}
+	auths := strings.Fields(auHead)
+	if len(auths) != 2 || auths[0] != "Bearer" {
+		return nil
+	}
+
+	var claims containerTokenClaims
+	token, err := jwt.ParseWithClaims(auths[1], &claims, func(t *jwt.Token) (interface{}, error) {
+		return oauth2.DefaultSigningKey.VerifyKey(), nil
+	})
+	if err != nil || !token.Valid {
+		log.Warn("OAuth2Token: invalid container registry token: %v", err)
+		return nil
+	}
+
+	scope := containerScope(req)
+	if scope != "" && !claims.allows(scope) {
+		log.Warn("OAuth2Token: token for subject %s does not grant access to %s", claims.Subject, scope)
+		return nil
+	}
+
+	user, err := models.GetUserByID(parseID(claims.Subject))
+	if err != nil {
+		log.Error("GetUserByID: %v", err)
+		return nil
+	}
+	return user
+}
+
+func (c containerTokenClaims) allows(scope string) bool {
+	for _, a := range c.Access {
+		if a.Name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeContainerToken implements the `/v2/token` side of the Docker/OCI token dance. It does
+// not authenticate the request itself: user is whoever the caller's SSO methods (e.g. Basic)
+// already resolved. A nil user gets a 401 with the WWW-Authenticate challenge; otherwise it
+// writes back a short-lived JWT scoped to whichever of the requested
+// `scope` query parameter's actions (`repository:owner/name:pull,push`) the user actually
+// has permission for.
+func ServeContainerToken(w http.ResponseWriter, req *http.Request, user *models.User) {
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", ContainerAuthenticateHeader(req))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var scope, actionStr string
+	if raw := req.URL.Query().Get("scope"); raw != "" {
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) == 3 && parts[0] == "repository" {
+			scope = parts[1]
+			actionStr = parts[2]
+		}
+	}
+
+	var actions []string
+	if scope != "" {
+		actions = allowedContainerActions(user, scope, strings.Split(actionStr, ","))
+		if len(actions) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	token, err := IssueContainerToken(user, scope, actions)
+	if err != nil {
+		log.Error("IssueContainerToken: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"token":%q,"access_token":%q,"expires_in":%d}`,
+		token, token, int(containerTokenTTL.Seconds()))
+}
+
+// allowedContainerActions intersects the requested actions against user's real permission on
+// the "<owner>/<name>" repository denoted by scope, the same access check Basic/API auth uses
+// elsewhere - the scope string itself is client-supplied and must never be trusted on its own.
+func allowedContainerActions(user *models.User, scope string, requested []string) []string {
+	ownerName := strings.SplitN(scope, "/", 2)
+	if len(ownerName) != 2 {
+		return nil
+	}
+
+	repo, err := models.GetRepositoryByOwnerAndName(ownerName[0], ownerName[1])
+	if err != nil {
+		if !models.IsErrRepoNotExist(err) {
+			log.Error("GetRepositoryByOwnerAndName: %v", err)
+		}
+		return nil
+	}
+
+	mode, err := models.AccessLevel(user, repo)
+	if err != nil {
+		log.Error("AccessLevel: %v", err)
+		return nil
+	}
+
+	allowed := make([]string, 0, len(requested))
+	for _, action := range requested {
+		switch action {
+		case "pull":
+			if mode >= models.AccessModeRead {
+				allowed = append(allowed, action)
+			}
+		case "push":
+			if mode >= models.AccessModeWrite {
+				allowed = append(allowed, action)
+			}
+		}
+	}
+	return allowed
+}
+
+func parseID(s string) int64 {
+	var id int64
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0
+		}
+		id = id*10 + int64(r-'0')
+	}
+	return id
+}
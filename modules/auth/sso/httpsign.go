@@ -0,0 +1,380 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sso
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Ensure the struct implements the interface.
+var (
+	_ SingleSignOn = &HTTPSign{}
+)
+
+// httpSignNonceTTL is how long a seen signature is remembered for replay protection.
+const httpSignNonceTTL = 5 * time.Minute
+
+// seenSignatures is a best-effort, in-memory replay cache keyed by the full "Signature" header
+// value. A header that has already been accepted once is rejected on subsequent use for
+// httpSignNonceTTL.
+var seenSignatures = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+func rememberSignature(sig string) (isReplay bool) {
+	seenSignatures.Lock()
+	defer seenSignatures.Unlock()
+
+	now := time.Now()
+	for k, exp := range seenSignatures.m {
+		if exp.Before(now) {
+			delete(seenSignatures.m, k)
+		}
+	}
+
+	if exp, ok := seenSignatures.m[sig]; ok && exp.After(now) {
+		return true
+	}
+	seenSignatures.m[sig] = now.Add(httpSignNonceTTL)
+	return false
+}
+
+// HTTPSign implements the SingleSignOn interface and authenticates requests by verifying an
+// RFC-draft "Signature" HTTP header against one of the requesting user's registered SSH public
+// keys. It lets users push over HTTP or call the API using the same keypair they already use for
+// SSH, without typing a password or minting a token.
+type HTTPSign struct {
+}
+
+// Init does nothing
+func (h *HTTPSign) Init() error {
+	return nil
+}
+
+// Free does nothing
+func (h *HTTPSign) Free() error {
+	return nil
+}
+
+// IsEnabled returns true as this plugin is enabled by default and it is not possible to disable
+// it from settings.
+func (h *HTTPSign) IsEnabled() bool {
+	return true
+}
+
+// httpSignature holds the parsed contents of a "Signature" Authorization header as described by
+// the "Signing HTTP Messages" draft.
+type httpSignature struct {
+	keyID     string
+	algorithm string
+	headers   []string
+	signature []byte
+}
+
+func parseHTTPSignature(header string) (*httpSignature, error) {
+	sig := &httpSignature{headers: []string{"(created)"}}
+
+	for _, part := range splitSignatureParams(header) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		val := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		switch key {
+		case "keyId":
+			sig.keyID = val
+		case "algorithm":
+			sig.algorithm = val
+		case "headers":
+			sig.headers = strings.Fields(val)
+		case "signature":
+			decoded, err := base64.StdEncoding.DecodeString(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signature encoding: %v", err)
+			}
+			sig.signature = decoded
+		}
+	}
+
+	if sig.keyID == "" || len(sig.signature) == 0 {
+		return nil, fmt.Errorf("missing keyId or signature parameter")
+	}
+	return sig, nil
+}
+
+// splitSignatureParams splits a comma separated "key=value" parameter list, ignoring commas
+// that appear inside quoted values.
+func splitSignatureParams(header string) []string {
+	var parts []string
+	var cur strings.Builder
+	inQuotes := false
+	for _, r := range header {
+		switch r {
+		case '"':
+			inQuotes = !inQuotes
+			cur.WriteRune(r)
+		case ',':
+			if inQuotes {
+				cur.WriteRune(r)
+			} else {
+				parts = append(parts, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
+
+// signingString reconstructs the string that was signed by the client, following the order of
+// the "headers" parameter. Pseudo-headers "(request-target)", "(created)" and "(expires)" are
+// pulled from the request line and from the Signature header's own parameters.
+func (s *httpSignature) signingString(req *http.Request, created, expires string) (string, error) {
+	var lines []string
+	for _, h := range s.headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI()))
+		case "(created)":
+			if created == "" {
+				return "", fmt.Errorf("signature is missing required (created) parameter")
+			}
+			lines = append(lines, fmt.Sprintf("(created): %s", created))
+		case "(expires)":
+			if expires == "" {
+				return "", fmt.Errorf("signature is missing required (expires) parameter")
+			}
+			lines = append(lines, fmt.Sprintf("(expires): %s", expires))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", h, req.Header.Get(h)))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func verifyWithPublicKey(pubKey *models.PublicKey, data, sig []byte, algorithm string) bool {
+	parsed, _, _, _, err := models.ParsePublicKeyContent(pubKey.Content)
+	if err != nil {
+		log.Error("ParsePublicKeyContent: %v", err)
+		return false
+	}
+
+	switch k := parsed.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, data, sig)
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(k, h[:], sig)
+	case *rsa.PublicKey:
+		var hash crypto.Hash
+		switch algorithm {
+		case "rsa-sha512":
+			hash = crypto.SHA512
+		default:
+			hash = crypto.SHA256
+		}
+		hashed := hashSum(hash, data)
+		return rsa.VerifyPKCS1v15(k, hash, hashed, sig) == nil
+	default:
+		return false
+	}
+}
+
+func hashSum(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA512:
+		h := sha512.Sum512(data)
+		return h[:]
+	default:
+		h := sha256.Sum256(data)
+		return h[:]
+	}
+}
+
+// headerListed reports whether name (case-insensitively) appears in headers.
+func headerListed(headers []string, name string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresDigest reports whether req carries a body that the signature must therefore cover.
+// A GET/HEAD or truly empty-body request has nothing to bind a digest to. ContentLength is -1
+// for unknown-length bodies (e.g. "Transfer-Encoding: chunked", which git's http.postBuffer
+// uses for large pushes) - that case must still require a digest, so only an explicit 0 is
+// treated as bodyless.
+func requiresDigest(req *http.Request) bool {
+	return req.ContentLength != 0
+}
+
+// maxDigestBodyFallback is the digest buffering limit used when LFS configures no smaller one.
+const maxDigestBodyFallback = 1 << 30 // 1 GiB
+
+// maxDigestBodySize is the most verifyDigest will ever buffer into memory to compute a
+// digest, bounding the per-request memory cost of a signed push. It tracks the same ceiling
+// LFS already enforces on individual objects when one below maxDigestBodyFallback is
+// configured; otherwise the generous but finite fallback applies, since plain git pushes have
+// no tighter limit configured elsewhere.
+func maxDigestBodySize() int64 {
+	if setting.LFS.MaxFileSize > 0 && setting.LFS.MaxFileSize < maxDigestBodyFallback {
+		return setting.LFS.MaxFileSize
+	}
+	return maxDigestBodyFallback
+}
+
+// verifyDigest recomputes the SHA-256/SHA-512 digest of the request body and compares it to the
+// "Digest" header, as required when a body-bearing request (e.g. git-receive-pack) is signed.
+func verifyDigest(req *http.Request) bool {
+	digestHeader := req.Header.Get("Digest")
+	if digestHeader == "" {
+		return true
+	}
+
+	parts := strings.SplitN(digestHeader, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	algo := strings.ToUpper(strings.TrimSpace(parts[0]))
+
+	limit := maxDigestBodySize()
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		log.Error("Digest: failed to read request body: %v", err)
+		return false
+	}
+	if int64(len(body)) > limit {
+		log.Warn("Digest: request body exceeds the %d byte limit, refusing to hash it", limit)
+		return false
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var sum []byte
+	switch algo {
+	case "SHA-512":
+		h := sha512.Sum512(body)
+		sum = h[:]
+	default:
+		h := sha256.Sum256(body)
+		sum = h[:]
+	}
+
+	expected := base64.StdEncoding.EncodeToString(sum)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(parts[1])) == 1
+}
+
+// VerifyAuthData extracts and validates the "Signature" header of the request and returns the
+// owner of the SSH key that produced it. Git smart-HTTP and API requests are the primary target:
+// the default group registers HTTPSign only for requests outside ordinary browser navigation
+// (NotWebPath), ahead of Basic and Session.
+func (h *HTTPSign) VerifyAuthData(req *http.Request, w http.ResponseWriter, store SessionStore) *models.User {
+	header := req.Header.Get("Signature")
+	if len(header) == 0 {
+		return nil
+	}
+
+	sig, err := parseHTTPSignature(header)
+	if err != nil {
+		log.Warn("HTTPSign: %v", err)
+		return nil
+	}
+
+	var created, expires string
+	for _, kv := range splitSignatureParams(header) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "created":
+			created = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		case "expires":
+			expires = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		}
+	}
+
+	if expires != "" {
+		expUnix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Unix(expUnix, 0).Before(time.Now()) {
+			log.Warn("HTTPSign: signature for keyId %s has expired", sig.keyID)
+			return nil
+		}
+	}
+
+	if requiresDigest(req) && (!headerListed(sig.headers, "digest") || req.Header.Get("Digest") == "") {
+		log.Warn("HTTPSign: signature for keyId %s does not cover the request body (missing digest)", sig.keyID)
+		return nil
+	}
+
+	if !verifyDigest(req) {
+		log.Warn("HTTPSign: digest mismatch for keyId %s", sig.keyID)
+		return nil
+	}
+
+	data, err := sig.signingString(req, created, expires)
+	if err != nil {
+		log.Warn("HTTPSign: %v", err)
+		return nil
+	}
+
+	key, err := models.SearchPublicKeyByFingerprint(sig.keyID)
+	if err != nil {
+		if !models.IsErrKeyNotExist(err) {
+			log.Error("SearchPublicKeyByFingerprint: %v", err)
+		}
+		return nil
+	}
+
+	if !verifyWithPublicKey(key, []byte(data), sig.signature, sig.algorithm) {
+		log.Warn("HTTPSign: signature verification failed for keyId %s", sig.keyID)
+		return nil
+	}
+
+	// Only burn the replay-protection nonce once the signature has actually been verified -
+	// checking it any earlier would let an attacker poison the cache for a victim's keyId
+	// using a forged header that was never cryptographically valid, and would punish a
+	// legitimate client's retry of the very same (still-unauthenticated) request.
+	if rememberSignature(header) {
+		log.Warn("HTTPSign: rejecting replayed signature for keyId %s", sig.keyID)
+		return nil
+	}
+
+	user, err := models.GetUserByID(key.OwnerID)
+	if err != nil {
+		log.Error("GetUserByID: %v", err)
+		return nil
+	}
+
+	log.Trace("HTTPSign Authorization: Logged in user %-v", user)
+	return user
+}
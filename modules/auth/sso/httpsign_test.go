@@ -0,0 +1,118 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sso
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHTTPSignature(t *testing.T) {
+	header := `keyId="SHA256:abcdef",algorithm="ed25519",headers="(request-target) (created) digest",signature="AAAA"`
+
+	sig, err := parseHTTPSignature(header)
+	assert.NoError(t, err)
+	assert.Equal(t, "SHA256:abcdef", sig.keyID)
+	assert.Equal(t, "ed25519", sig.algorithm)
+	assert.Equal(t, []string{"(request-target)", "(created)", "digest"}, sig.headers)
+	assert.Equal(t, []byte{0, 0, 0}, sig.signature)
+}
+
+func TestParseHTTPSignatureMissingFields(t *testing.T) {
+	_, err := parseHTTPSignature(`algorithm="ed25519"`)
+	assert.Error(t, err)
+}
+
+func TestParseHTTPSignatureDefaultsToCreated(t *testing.T) {
+	sig, err := parseHTTPSignature(`keyId="k",signature="AAAA"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"(created)"}, sig.headers)
+}
+
+func TestSplitSignatureParamsIgnoresCommasInQuotes(t *testing.T) {
+	parts := splitSignatureParams(`headers="a, b, c",keyId="x,y"`)
+	assert.Equal(t, []string{`headers="a, b, c"`, `keyId="x,y"`}, parts)
+}
+
+func TestSigningStringOrdersByHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/owner/repo/git-receive-pack", nil)
+	req.Header.Set("Digest", "SHA-256=abc")
+
+	sig := &httpSignature{headers: []string{"(request-target)", "(created)", "digest"}}
+	data, err := sig.signingString(req, "1000", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "(request-target): post /owner/repo/git-receive-pack\n(created): 1000\ndigest: SHA-256=abc", data)
+}
+
+func TestSigningStringRequiresCreatedAndExpires(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	_, err := (&httpSignature{headers: []string{"(created)"}}).signingString(req, "", "")
+	assert.Error(t, err)
+
+	_, err = (&httpSignature{headers: []string{"(expires)"}}).signingString(req, "1000", "")
+	assert.Error(t, err)
+}
+
+func TestHeaderListed(t *testing.T) {
+	assert.True(t, headerListed([]string{"(created)", "Digest"}, "digest"))
+	assert.False(t, headerListed([]string{"(created)"}, "digest"))
+}
+
+func TestRequiresDigest(t *testing.T) {
+	withBody := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("hello")))
+	withBody.ContentLength = 5
+	assert.True(t, requiresDigest(withBody))
+
+	chunked := httptest.NewRequest(http.MethodPost, "/owner/repo/git-receive-pack", bytes.NewReader([]byte("pack data")))
+	chunked.ContentLength = -1 // unknown length, e.g. "Transfer-Encoding: chunked"
+	assert.True(t, requiresDigest(chunked), "a chunked push body must still require a covered digest")
+
+	noBody := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.False(t, requiresDigest(noBody))
+}
+
+func TestVerifyDigestAcceptsMatchingBody(t *testing.T) {
+	body := []byte("the body")
+	sum := sha256.Sum256(body)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+
+	assert.True(t, verifyDigest(req))
+	// The body must still be readable by later handlers (e.g. git-receive-pack).
+	replayed, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, replayed)
+}
+
+func TestVerifyDigestRejectsTamperedBody(t *testing.T) {
+	sum := sha256.Sum256([]byte("the original body"))
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("a swapped body")))
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+
+	assert.False(t, verifyDigest(req))
+}
+
+func TestVerifyDigestWithoutHeaderPassesTrivially(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("anything")))
+	assert.True(t, verifyDigest(req))
+}
+
+func TestRememberSignatureDetectsReplay(t *testing.T) {
+	seenSignatures.m = make(map[string]time.Time)
+
+	const header = `keyId="k",signature="AAAA"`
+	assert.False(t, rememberSignature(header), "first use should not be flagged as a replay")
+	assert.True(t, rememberSignature(header), "second use of the same signature must be rejected as a replay")
+	assert.False(t, rememberSignature(header+"x"), "a distinct signature is unaffected")
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sso
+
+import (
+	"net/http"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// CookieNameRememberMe is the name of the cookie holding the selector:validator remember-me
+// token. Its value is opaque and, unlike the scheme it replaces, cannot be reconstructed from
+// the `auth_token` table alone.
+const CookieNameRememberMe = "gitea_incredible"
+
+// SetRememberMeCookie issues a fresh selector/verifier pair for user and stores it in the
+// remember-me cookie. It is called by handleSignIn's counterparts whenever the user opted in
+// to staying signed in.
+func SetRememberMeCookie(resp http.ResponseWriter, req *http.Request, user *models.User) {
+	expires := timeutil.TimeStampNow().Add(int64(setting.LogInRememberDays * 86400))
+	value, err := models.NewAuthToken(user.ID, expires)
+	if err != nil {
+		log.Error("NewAuthToken: %v", err)
+		return
+	}
+
+	http.SetCookie(resp, &http.Cookie{
+		Name:     CookieNameRememberMe,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   setting.SessionConfig.Secure,
+		Expires:  expires.AsTime(),
+	})
+}
+
+// DeleteRememberMeCookie clears the remember-me cookie, used on explicit sign-out.
+func DeleteRememberMeCookie(resp http.ResponseWriter) {
+	http.SetCookie(resp, &http.Cookie{
+		Name:     CookieNameRememberMe,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+}
+
+// VerifyRememberMeCookie validates the remember-me cookie on req, if any, rotating it on
+// success. On a validator mismatch for a known selector it revokes every token for the
+// implicated user, since that indicates a stolen cookie value was replayed.
+func VerifyRememberMeCookie(resp http.ResponseWriter, req *http.Request) *models.User {
+	cookie, err := req.Cookie(CookieNameRememberMe)
+	if err != nil || len(cookie.Value) == 0 {
+		return nil
+	}
+
+	user, newValue, err := models.VerifyAuthToken(cookie.Value)
+	if err != nil {
+		log.Warn("VerifyAuthToken: %v", err)
+		DeleteRememberMeCookie(resp)
+		return nil
+	}
+
+	http.SetCookie(resp, &http.Cookie{
+		Name:     CookieNameRememberMe,
+		Value:    newValue,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   setting.SessionConfig.Secure,
+		Expires:  timeutil.TimeStampNow().Add(int64(setting.LogInRememberDays * 86400)).AsTime(),
+	})
+
+	return user
+}
@@ -6,11 +6,13 @@
 package sso
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"code.gitea.io/gitea/models"
 	"code.gitea.io/gitea/modules/log"
@@ -18,38 +20,89 @@ import (
 	"code.gitea.io/gitea/modules/web/middleware"
 )
 
-// ssoMethods contains the list of SSO authentication plugins in the order they are expected to be
-// executed.
+// ErrPasskeyRequired is returned by HandleSignIn when user has one or more passkeys
+// registered but the current session has not completed a WebAuthn assertion for them.
+var ErrPasskeyRequired = errors.New("sso: passkey verification required before sign-in can complete")
+
+// sessionKeyPasskeyPendingUID stashes the id of the user a sign-in is waiting on a passkey
+// assertion for. HandleSignIn sets it and handleSignIn clears it; nothing in this package reads
+// it back, and webauthn.FinishLogin takes the user as an argument rather than from this key.
+const sessionKeyPasskeyPendingUID = "passkeyPendingUID"
+
+// Priorities of the built-in SSO methods. Lower runs first. These replace what used to be an
+// implicit convention ("OAuth2 must come first") encoded only by slice position; see Group.
+const (
+	priorityOAuth2 = iota * 10
+	priorityHTTPSign
+	priorityOAuth2Token
+	priorityBasic
+	prioritySession
+	priorityWebAuthn
+	priorityReverseProxy
+)
+
+// defaultGroup holds the built-in SSO methods, each registered with the priority and
+// applicability it is expected to run under.
+//
+// The OAuth2 plugin runs first and against every request, as it must ignore the user id
+// stored in the session (if there is a user id stored in session other plugins might return
+// the user object for that id).
 //
-// The OAuth2 plugin is expected to be executed first, as it must ignore the user id stored
-// in the session (if there is a user id stored in session other plugins might return the user
-// object for that id).
+// HTTPSign and OAuth2Token only apply outside ordinary browser navigation: the former wants
+// git/API requests carrying a "Signature" header, the latter wants container registry
+// requests carrying a bearer JWT.
 //
-// The Session plugin is expected to be executed second, in order to skip authentication
-// for users that have already signed in.
-var ssoMethods = []SingleSignOn{
-	&OAuth2{},
-	&Basic{},
-	&Session{},
-	&ReverseProxy{},
+// Basic is skipped for browser HTML paths unless BasicAuth is explicitly enabled for them,
+// so a stray Authorization header on a page load doesn't trigger a password prompt.
+//
+// Session applies to everything except git/LFS/container clients, which never carry a
+// meaningful session cookie; the web UI's own same-origin API calls do, so it still applies
+// to the API class. WebAuthn is narrower still: its session flag only means anything during
+// the interactive sign-in flow it belongs to.
+var defaultGroup = func() *Group {
+	g := &Group{}
+	g.Register(&OAuth2{}, priorityOAuth2, AnyPath)
+	g.Register(&HTTPSign{}, priorityHTTPSign, NotWebPath)
+	g.Register(&OAuth2Token{}, priorityOAuth2Token, isContainerPath)
+	g.Register(&Basic{}, priorityBasic, func(req *http.Request) bool {
+		return NotWebPath(req) || setting.Service.EnableBasicAuth
+	})
+	g.Register(&Session{}, prioritySession, func(req *http.Request) bool {
+		return !GitLFSOrContainerPath(req)
+	})
+	g.Register(&WebAuthn{}, priorityWebAuthn, isWebHTMLPath)
+	g.Register(&ReverseProxy{}, priorityReverseProxy, AnyPath)
+	return g
+}()
+
+// Methods returns the instances of all registered SSO methods, in priority order.
+func Methods() []SingleSignOn {
+	return defaultGroup.Methods()
 }
 
-// The purpose of the following three function variables is to let the linter know that
-// those functions are not dead code and are actually being used
-var (
-	_ = handleSignIn
-)
-
-// Methods returns the instances of all registered SSO methods
-func Methods() []SingleSignOn {
-	return ssoMethods
+// MethodsForRequest returns the registered SSO methods applicable to req, in priority order.
+// Callers should try each in turn and stop at the first one that returns a non-nil user.
+func MethodsForRequest(req *http.Request) []SingleSignOn {
+	return defaultGroup.MethodsForRequest(req)
 }
 
-// Register adds the specified instance to the list of available SSO methods
+// Register adds method to the default group, applicable to every request and run after all
+// built-in methods. Plugins that need to run earlier, or only for certain kinds of request,
+// should use RegisterWithPriority instead.
 func Register(method SingleSignOn) {
-	ssoMethods = append(ssoMethods, method)
+	defaultGroup.Register(method, priorityReverseProxy+10, AnyPath)
 }
 
+// RegisterWithPriority adds method to the default group with an explicit priority and
+// applicability predicate, letting third-party plugins slot into the dispatch order without
+// editing this file or caring about the built-ins' slice position.
+func RegisterWithPriority(method SingleSignOn, priority int, appliesTo AppliesTo) {
+	defaultGroup.Register(method, priority, appliesTo)
+}
+
+// authTokenReapInterval is how often expired remember-me tokens are purged from auth_token.
+const authTokenReapInterval = time.Hour
+
 // Init should be called exactly once when the application starts to allow SSO plugins
 // to allocate necessary resources
 func Init() {
@@ -59,6 +112,8 @@ func Init() {
 			log.Error("Could not initialize '%s' SSO method, error: %s", reflect.TypeOf(method).String(), err)
 		}
 	}
+
+	go models.StartAuthTokenReaper(authTokenReapInterval)
 }
 
 // Free should be called exactly once when the application is terminating to allow SSO plugins
@@ -107,6 +162,8 @@ func isAttachmentDownload(req *http.Request) bool {
 var gitPathRe = regexp.MustCompile(`^/[a-zA-Z0-9_.-]+/[a-zA-Z0-9_.-]+/(?:(?:git-(?:(?:upload)|(?:receive))-pack$)|(?:info/refs$)|(?:HEAD$)|(?:objects/))`)
 var lfsPathRe = regexp.MustCompile(`^/[a-zA-Z0-9_.-]+/[a-zA-Z0-9_.-]+/info/lfs/`)
 
+// isGitOrLFSPath, like isContainerPath, marks a request as belonging to a non-interactive
+// client: such requests should skip session-only auth and prefer credential-bearing methods.
 func isGitOrLFSPath(req *http.Request) bool {
 	if gitPathRe.MatchString(req.URL.Path) {
 		return true
@@ -117,7 +174,38 @@ func isGitOrLFSPath(req *http.Request) bool {
 	return false
 }
 
-// handleSignIn clears existing session variables and stores new ones for the specified user object
+// HandleSignIn finishes signing user in, but first enforces the passkey step: if user has one
+// or more passkeys registered, sessionKeyWebAuthnVerifiedUID must already hold user.ID (i.e. a
+// WebAuthn assertion for this exact user has already completed in this session). If it
+// doesn't, ErrPasskeyRequired is returned and uid is NOT set - the caller must send the
+// browser through the begin/finish login ceremony in modules/auth/webauthn and call
+// HandleSignIn again afterwards, rather than falling back to password/2FA alone.
+//
+// A user with no registered passkeys is unaffected and signs in immediately, same as before
+// passkeys existed.
+func HandleSignIn(resp http.ResponseWriter, req *http.Request, sess SessionStore, user *models.User) error {
+	hasPasskey, err := models.HasWebAuthnRegistration(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if hasPasskey {
+		verifiedUID, _ := sess.Get(sessionKeyWebAuthnVerifiedUID).(int64)
+		if verifiedUID != user.ID {
+			if err := sess.Set(sessionKeyPasskeyPendingUID, user.ID); err != nil {
+				return err
+			}
+			return ErrPasskeyRequired
+		}
+	}
+
+	handleSignIn(resp, req, sess, user)
+	return nil
+}
+
+// handleSignIn clears existing session variables and stores new ones for the specified user
+// object. It must only be called once any passkey requirement for user has been satisfied;
+// use HandleSignIn, which enforces that, rather than calling this directly.
 func handleSignIn(resp http.ResponseWriter, req *http.Request, sess SessionStore, user *models.User) {
 	_ = sess.Delete("openid_verified_uri")
 	_ = sess.Delete("openid_signin_remember")
@@ -127,6 +215,9 @@ func handleSignIn(resp http.ResponseWriter, req *http.Request, sess SessionStore
 	_ = sess.Delete("twofaRemember")
 	_ = sess.Delete("u2fChallenge")
 	_ = sess.Delete("linkAccount")
+	_ = sess.Delete(sessionKeyWebAuthnVerifiedUID)
+	_ = sess.Delete(sessionKeyPasskeyPendingUID)
+	DeleteRememberMeCookie(resp)
 	err := sess.Set("uid", user.ID)
 	if err != nil {
 		log.Error(fmt.Sprintf("Error setting session: %v", err))
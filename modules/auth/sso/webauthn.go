@@ -0,0 +1,67 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package sso
+
+import (
+	"net/http"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/auth/webauthn"
+)
+
+// Ensure the struct implements the interface.
+var (
+	_ SingleSignOn = &WebAuthn{}
+)
+
+// sessionKeyWebAuthnVerifiedUID is set by webauthn.FinishLogin once a passkey assertion has
+// been verified for the sign-in session currently in progress, letting HandleSignIn know that
+// the passkey step of sign-in is already satisfied for that user.
+const sessionKeyWebAuthnVerifiedUID = webauthn.SessionKeyVerifiedUID
+
+// WebAuthn implements the SingleSignOn interface. It does not itself perform a WebAuthn
+// ceremony (that happens out-of-band against the dedicated begin/finish endpoints in
+// modules/auth/webauthn) - it simply recognises a session that has already completed one and
+// resolves the corresponding user, the same way Session recognises an already-established
+// "uid".
+type WebAuthn struct {
+}
+
+// Init configures the package-level WebAuthn relying party.
+func (a *WebAuthn) Init() error {
+	webauthn.Init()
+	return nil
+}
+
+// Free does nothing
+func (a *WebAuthn) Free() error {
+	return nil
+}
+
+// IsEnabled returns true as this plugin is enabled by default and it is not possible to
+// disable it from settings.
+func (a *WebAuthn) IsEnabled() bool {
+	return true
+}
+
+// VerifyAuthData returns the user recorded by a prior, already-verified passkey assertion for
+// this session, if any.
+func (a *WebAuthn) VerifyAuthData(req *http.Request, w http.ResponseWriter, store SessionStore) *models.User {
+	uid := store.Get(sessionKeyWebAuthnVerifiedUID)
+	if uid == nil {
+		return nil
+	}
+
+	id, ok := uid.(int64)
+	if !ok {
+		return nil
+	}
+
+	user, err := models.GetUserByID(id)
+	if err != nil {
+		return nil
+	}
+	return user
+}
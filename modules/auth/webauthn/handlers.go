@@ -0,0 +1,157 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package webauthn
+
+import (
+	"fmt"
+	"net/http"
+
+	"code.gitea.io/gitea/models"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+// Session is the subset of the session store the ceremony handlers need to stash the
+// in-progress challenge between the "begin" and "finish" calls of a ceremony.
+type Session interface {
+	Get(key string) interface{}
+	Set(key string, value interface{}) error
+	Delete(key string) error
+}
+
+const sessionKeyWebAuthnData = "webauthnSessionData"
+
+// SessionKeyVerifiedUID is the session key FinishLogin sets to the verified user's ID on a
+// successful assertion. modules/auth/sso.WebAuthn looks for this same key to recognise that
+// the passkey step of sign-in has already been satisfied for the session.
+const SessionKeyVerifiedUID = "webauthnVerifiedUID"
+
+// BeginRegistration starts a registration ceremony for an already authenticated user and
+// returns the CredentialCreation options to be sent to the browser.
+func BeginRegistration(u *models.User, sess Session) (*protocol.CredentialCreation, error) {
+	wu, err := newUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	options, sessionData, err := WebAuthn.BeginRegistration(wu)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Set(sessionKeyWebAuthnData, *sessionData); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// FinishRegistration completes a registration ceremony, persisting the new passkey for u.
+func FinishRegistration(u *models.User, name string, sess Session, req *http.Request) (*models.WebAuthnCredential, error) {
+	wu, err := newUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionData, ok := sess.Get(sessionKeyWebAuthnData).(webauthn.SessionData)
+	if !ok {
+		return nil, fmt.Errorf("no in-progress WebAuthn registration for user %d", u.ID)
+	}
+	_ = sess.Delete(sessionKeyWebAuthnData)
+
+	cred, err := WebAuthn.FinishRegistration(wu, sessionData, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.CreateCredential(u.ID, name, cred.ID, cred.PublicKey, cred.Authenticator.AAGUID, cred.AttestationType, cred.Authenticator.SignCount)
+}
+
+// BeginLogin starts a login ceremony for a known user (the username has already been
+// submitted in the sign-in form).
+func BeginLogin(u *models.User, sess Session) (*protocol.CredentialAssertion, error) {
+	wu, err := newUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	options, sessionData, err := WebAuthn.BeginLogin(wu)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Set(sessionKeyWebAuthnData, *sessionData); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// BeginDiscoverableLogin starts a usernameless login ceremony: the browser is simply asked to
+// produce an assertion from any passkey it holds for this relying party, and the user is
+// resolved afterwards from the assertion's credential ID.
+func BeginDiscoverableLogin(sess Session) (*protocol.CredentialAssertion, error) {
+	options, sessionData, err := WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Set(sessionKeyWebAuthnData, *sessionData); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// FinishLogin completes a login ceremony and returns the verified user. When u is nil, the
+// user is looked up from the assertion's credential ID (the discoverable/usernameless path).
+func FinishLogin(u *models.User, sess Session, req *http.Request) (*models.User, error) {
+	sessionData, ok := sess.Get(sessionKeyWebAuthnData).(webauthn.SessionData)
+	if !ok {
+		return nil, fmt.Errorf("no in-progress WebAuthn login")
+	}
+	_ = sess.Delete(sessionKeyWebAuthnData)
+
+	if u != nil {
+		wu, err := newUser(u)
+		if err != nil {
+			return nil, err
+		}
+		cred, err := WebAuthn.FinishLogin(wu, sessionData, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := updateSignCount(u.ID, cred); err != nil {
+			return nil, err
+		}
+		return u, sess.Set(SessionKeyVerifiedUID, u.ID)
+	}
+
+	var resolved *models.User
+	cred, err := WebAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		dbCred, err := models.GetWebAuthnCredentialByCredID(rawID)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err = models.GetUserByID(dbCred.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return newUser(resolved)
+	}, sessionData, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := updateSignCount(resolved.ID, cred); err != nil {
+		return nil, err
+	}
+
+	return resolved, sess.Set(SessionKeyVerifiedUID, resolved.ID)
+}
+
+func updateSignCount(userID int64, cred *webauthn.Credential) error {
+	dbCred, err := models.GetWebAuthnCredentialByCredID(cred.ID)
+	if err != nil {
+		return err
+	}
+	dbCred.SignCount = cred.Authenticator.SignCount
+	dbCred.CloneWarning = cred.Authenticator.CloneWarning
+	return dbCred.UpdateSignCount()
+}
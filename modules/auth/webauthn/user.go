@@ -0,0 +1,67 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package webauthn
+
+import (
+	"encoding/base64"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+// user adapts a models.User and its registered passkeys to the webauthn.User interface
+// expected by the duo-labs/webauthn library.
+type user struct {
+	*models.User
+	creds []*models.WebAuthnCredential
+}
+
+// newUser loads u's registered passkeys and wraps it for use in a ceremony.
+func newUser(u *models.User) (*user, error) {
+	creds, err := models.GetWebAuthnCredentialsByUID(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &user{User: u, creds: creds}, nil
+}
+
+func (u *user) WebAuthnID() []byte {
+	return []byte(u.User.LowerName)
+}
+
+func (u *user) WebAuthnName() string {
+	return u.User.Name
+}
+
+func (u *user) WebAuthnDisplayName() string {
+	return u.User.DisplayName()
+}
+
+func (u *user) WebAuthnIcon() string {
+	return u.User.AvatarLink()
+}
+
+func (u *user) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.creds))
+	for _, c := range u.creds {
+		rawID, err := base64.RawStdEncoding.DecodeString(c.CredentialID)
+		if err != nil {
+			log.Error("WebAuthnCredentials: stored credential ID %d is not valid base64: %v", c.ID, err)
+			continue
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:              rawID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return creds
+}
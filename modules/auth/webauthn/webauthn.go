@@ -0,0 +1,38 @@
+// Copyright 2019 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package webauthn
+
+import (
+	"net/url"
+	"strings"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+// WebAuthn is the configured instance used to run registration and login ceremonies. It is
+// populated by Init and is nil until then.
+var WebAuthn *webauthn.WebAuthn
+
+// Init configures the WebAuthn relying party from setting and must be called once during
+// application start-up, before any ceremony handler runs.
+func Init() {
+	parsed, err := url.Parse(setting.AppURL)
+	if err != nil {
+		log.Fatal("Unable to parse AppURL %s: %v", setting.AppURL, err)
+		return
+	}
+
+	WebAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: setting.AppName,
+		RPID:          parsed.Hostname(),
+		RPOrigin:      strings.TrimSuffix(setting.AppURL, "/"),
+	})
+	if err != nil {
+		log.Fatal("Failed to create WebAuthn relying party: %v", err)
+	}
+}